@@ -0,0 +1,58 @@
+package ring
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// opaqueReader hides any io.ByteReader the underlying reader might
+// implement, forcing DecodeHeader down its non-ByteReader path - the one
+// that must not read ahead past the header.
+type opaqueReader struct {
+	r io.Reader
+}
+
+func (o opaqueReader) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+func TestCodecRoundTrip(t *testing.T) {
+	body := []byte("hello ring")
+	codecs := map[string]Codec{
+		"BinaryCodec":                BinaryCodec{},
+		"VarintCodec":                VarintCodec{},
+		"SelfDescribingCodec":        SelfDescribingCodec{},
+		"SelfDescribingCodec/Varint": SelfDescribingCodec{Inner: VarintCodec{}},
+	}
+	for name, codec := range codecs {
+		codec := codec
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := codec.EncodeHeader(&buf, 42, uint64(len(body))); err != nil {
+				t.Fatalf("EncodeHeader: %v", err)
+			}
+			buf.Write(body)
+
+			// Route through opaqueReader so a non-ByteReader codec can't
+			// fall back to wrapping r in a bufio.Reader and silently
+			// stealing bytes that belong to the body.
+			r := opaqueReader{&buf}
+			msgType, length, err := codec.DecodeHeader(r)
+			if err != nil {
+				t.Fatalf("DecodeHeader: %v", err)
+			}
+			if msgType != 42 {
+				t.Fatalf("msgType = %d, want 42", msgType)
+			}
+			if length != uint64(len(body)) {
+				t.Fatalf("length = %d, want %d", length, len(body))
+			}
+			got := make([]byte, length)
+			if _, err := io.ReadFull(r, got); err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Fatalf("body = %q, want %q", got, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package ring
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTTL is how long a connection may go without traffic before the
+// reaper closes and removes it.
+var DefaultIdleTTL = 5 * time.Minute
+
+// DefaultReaperInterval is how often the reaper sweeps the pool for idle
+// connections.
+var DefaultReaperInterval = time.Minute
+
+// DefaultDialBackoffBase and DefaultDialBackoffMax bound the capped
+// exponential backoff applied between dial attempts to an address that
+// keeps failing.
+var (
+	DefaultDialBackoffBase = time.Second
+	DefaultDialBackoffMax  = time.Minute
+)
+
+// DefaultCircuitBreakerThreshold is how many consecutive dial failures to
+// an address trip its circuit breaker.
+var DefaultCircuitBreakerThreshold = 5
+
+// DefaultCircuitBreakerCooldown is how long a tripped circuit stays open -
+// failing every dial immediately - before another real attempt is allowed.
+var DefaultCircuitBreakerCooldown = 30 * time.Second
+
+type dialResult struct {
+	conn *RingConn
+	err  error
+}
+
+// addrHealth tracks per-address dial and traffic history, independent of
+// whether a live connection currently exists for that address.
+type addrHealth struct {
+	consecutiveFailures int
+	lastFailure         time.Time
+	lastTraffic         time.Time
+}
+
+// connPool owns TCPMsgRing's live connections along with the bookkeeping
+// needed to coalesce concurrent dials to the same address, reap idle
+// connections, and back off from addresses that keep failing.
+type connPool struct {
+	mu       sync.RWMutex
+	conns    map[string]*RingConn
+	inflight map[string][]chan dialResult
+	health   map[string]*addrHealth
+}
+
+func newConnPool() *connPool {
+	return &connPool{
+		conns:    make(map[string]*RingConn),
+		inflight: make(map[string][]chan dialResult),
+		health:   make(map[string]*addrHealth),
+	}
+}
+
+func (p *connPool) get(addr string) (*RingConn, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	c, ok := p.conns[addr]
+	return c, ok
+}
+
+// snapshot returns the currently connected addresses and connections, safe
+// to range over without holding the pool's lock.
+func (p *connPool) snapshot() map[string]*RingConn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]*RingConn, len(p.conns))
+	for addr, c := range p.conns {
+		out[addr] = c
+	}
+	return out
+}
+
+// touch records that traffic just flowed to/from addr, resetting the idle
+// clock the reaper watches.
+func (p *connPool) touch(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthFor(addr).lastTraffic = time.Now()
+}
+
+// healthFor returns addr's health record, creating it if necessary. Callers
+// must hold p.mu.
+func (p *connPool) healthFor(addr string) *addrHealth {
+	h, ok := p.health[addr]
+	if !ok {
+		h = &addrHealth{}
+		p.health[addr] = h
+	}
+	return h
+}
+
+// circuitOpen reports whether addr has failed enough times recently that a
+// dial should be skipped - failed fast - rather than actually attempted.
+func (p *connPool) circuitOpen(addr string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	h, ok := p.health[addr]
+	if !ok || h.consecutiveFailures < DefaultCircuitBreakerThreshold {
+		return false
+	}
+	return time.Since(h.lastFailure) < DefaultCircuitBreakerCooldown
+}
+
+// backoffLocked returns how long to wait before the next dial attempt to
+// addr, based on its current consecutive failure count. Callers must hold
+// p.mu.
+func (p *connPool) backoffLocked(addr string) time.Duration {
+	h, ok := p.health[addr]
+	if !ok || h.consecutiveFailures == 0 {
+		return 0
+	}
+	// Double step by step rather than shifting, so a long run of failures
+	// stops at the cap instead of overflowing time.Duration.
+	d := DefaultDialBackoffBase
+	for i := 1; i < h.consecutiveFailures && d < DefaultDialBackoffMax; i++ {
+		d *= 2
+	}
+	if d > DefaultDialBackoffMax {
+		d = DefaultDialBackoffMax
+	}
+	return d
+}
+
+// recordFailureLocked records a dial failure for addr. Callers must hold
+// p.mu.
+func (p *connPool) recordFailureLocked(addr string) {
+	h := p.healthFor(addr)
+	h.consecutiveFailures++
+	h.lastFailure = time.Now()
+}
+
+// recordSuccessLocked clears addr's failure count after a successful dial.
+// Callers must hold p.mu.
+func (p *connPool) recordSuccessLocked(addr string) {
+	h := p.healthFor(addr)
+	h.consecutiveFailures = 0
+	h.lastTraffic = time.Now()
+}
+
+// remove drops addr's entry without closing the connection; callers that
+// know the connection is already dead should call RingConn.Close instead,
+// which calls back into remove itself.
+func (p *connPool) remove(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, addr)
+}
+
+// put registers conn as the live connection for addr, used by the accept
+// side of TCPMsgRing.handle, which doesn't go through dial.
+func (p *connPool) put(addr string, conn *RingConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[addr] = conn
+	conn.pool = p
+	conn.poolAddr = addr
+	p.recordSuccessLocked(addr)
+}
+
+// dial coalesces concurrent dials to the same address: the first caller to
+// reach dial for a given addr actually runs dialFunc, while every other
+// caller blocks on a channel fed the same result, so N goroutines targeting
+// one address only ever produce one net.DialTimeout. Before dialing, it
+// waits out any backoff accrued from previous failures to addr, and on
+// return it updates addr's health so a circuit breaker can trip after
+// repeated failures.
+func (p *connPool) dial(addr string, dialFunc func() (*RingConn, error)) (*RingConn, error) {
+	p.mu.Lock()
+	if c, ok := p.conns[addr]; ok {
+		p.mu.Unlock()
+		return c, nil
+	}
+	if waiters, inFlight := p.inflight[addr]; inFlight {
+		ch := make(chan dialResult, 1)
+		p.inflight[addr] = append(waiters, ch)
+		p.mu.Unlock()
+		res := <-ch
+		return res.conn, res.err
+	}
+	p.inflight[addr] = nil
+	wait := p.backoffLocked(addr)
+	p.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	conn, err := dialFunc()
+
+	p.mu.Lock()
+	waiters := p.inflight[addr]
+	delete(p.inflight, addr)
+	if err != nil {
+		p.recordFailureLocked(addr)
+	} else {
+		p.conns[addr] = conn
+		conn.pool = p
+		conn.poolAddr = addr
+		p.recordSuccessLocked(addr)
+	}
+	p.mu.Unlock()
+
+	for _, ch := range waiters {
+		ch <- dialResult{conn, err}
+	}
+	return conn, err
+}
+
+// startReaper launches a goroutine that periodically closes connections
+// that have carried no traffic for ttl.
+func (p *connPool) startReaper(ttl, interval time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultIdleTTL
+	}
+	if interval <= 0 {
+		interval = DefaultReaperInterval
+	}
+	go p.reapLoop(ttl, interval)
+}
+
+func (p *connPool) reapLoop(ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.reapOnce(ttl)
+	}
+}
+
+func (p *connPool) reapOnce(ttl time.Duration) {
+	now := time.Now()
+	var stale []*RingConn
+	p.mu.RLock()
+	for addr, conn := range p.conns {
+		if h, ok := p.health[addr]; ok && now.Sub(h.lastTraffic) > ttl {
+			stale = append(stale, conn)
+		}
+	}
+	p.mu.RUnlock()
+	for _, conn := range stale {
+		log.Println("Reaping idle connection to", conn.poolAddr)
+		conn.Close() // Close notifies the pool, removing its entry.
+	}
+}
@@ -0,0 +1,151 @@
+package ring
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// handshakeMagic identifies the start of a handshake frame, guarding against
+// a peer speaking a completely different protocol on the same port.
+const handshakeMagic uint32 = 0x52494e47 // "RING"
+
+// handshakeVersion is the version of the handshake frame itself, not to be
+// confused with the Ring's Version(). Bumping this lets future releases
+// change the frame layout while still being able to recognize (and reject)
+// older peers.
+const handshakeVersion uint16 = 1
+
+// DefaultMsgSize is the msize (maximum message size) a TCPMsgRing proposes
+// during the handshake when none has been configured.
+var DefaultMsgSize uint64 = 16 * 1024 * 1024 // 16Mb
+
+// handshakeFrame is the fixed-size frame exchanged by both peers immediately
+// after a TCP connection is established, before any user messages flow.
+type handshakeFrame struct {
+	Magic            uint32
+	HandshakeVersion uint16
+	RingVersion      int64
+	LocalNodeID      uint64
+	MaxMsgSize       uint64
+}
+
+// writeHandshake sends this node's handshake frame on conn.
+func writeHandshake(conn *RingConn, ringVersion int64, localNodeID uint64, maxMsgSize uint64) error {
+	frame := handshakeFrame{
+		Magic:            handshakeMagic,
+		HandshakeVersion: handshakeVersion,
+		RingVersion:      ringVersion,
+		LocalNodeID:      localNodeID,
+		MaxMsgSize:       maxMsgSize,
+	}
+	if err := binary.Write(conn.Writer, binary.LittleEndian, &frame); err != nil {
+		return err
+	}
+	return conn.Writer.Flush()
+}
+
+// readHandshake reads and validates a peer's handshake frame from conn,
+// using its shared Reader so any bytes TimeoutReader buffers ahead of the
+// frame (e.g. the start of the first chunk, if it arrived in the same
+// segment) stay available to demux instead of being stranded in a
+// throwaway reader.
+func readHandshake(conn *RingConn) (handshakeFrame, error) {
+	var frame handshakeFrame
+	if err := binary.Read(conn.Reader, binary.LittleEndian, &frame); err != nil {
+		return frame, err
+	}
+	if frame.Magic != handshakeMagic {
+		return frame, errors.New("handshake: bad magic, peer is not speaking the ring protocol")
+	}
+	if frame.HandshakeVersion != handshakeVersion {
+		return frame, fmt.Errorf("handshake: unsupported handshake version %d", frame.HandshakeVersion)
+	}
+	return frame, nil
+}
+
+// SetRingVersionMismatchHandler sets the callback invoked whenever a
+// handshake reveals that a peer is running an older or newer ring version
+// than the local node. The handler receives the peer's NodeID and ring
+// version along with the local ring version so the caller can decide
+// whether to drop or defer traffic to/from that peer.
+func (m *TCPMsgRing) SetRingVersionMismatchHandler(handler func(peerNodeID uint64, peerRingVersion int64, localRingVersion int64)) {
+	m.ringVersionMismatchHandler = handler
+}
+
+// SetMsgSize sets the msize this node proposes to peers during the
+// handshake. Defaults to DefaultMsgSize.
+func (m *TCPMsgRing) SetMsgSize(msize uint64) {
+	m.msgSize = msize
+}
+
+func (m *TCPMsgRing) localMsgSize() uint64 {
+	if m.msgSize == 0 {
+		return DefaultMsgSize
+	}
+	return m.msgSize
+}
+
+// handshake performs the handshake for an already-established connection,
+// negotiating the msize (the lesser of the two proposed values) and
+// recording the peer's NodeID and ring version on conn. expectedNodeID, if
+// non-zero, is the NodeID the caller expects to be on the other end (as is
+// the case when we dialed the connection ourselves); if the peer reports a
+// different NodeID, the handshake fails.
+func (m *TCPMsgRing) handshake(conn *RingConn, expectedNodeID uint64) error {
+	ring := m.currentRing()
+	var readErr error
+	var frame handshakeFrame
+	done := make(chan struct{})
+	go func() {
+		frame, readErr = readHandshake(conn)
+		close(done)
+	}()
+	writeErr := writeHandshake(conn, ring.Version(), ring.LocalNodeID(), m.localMsgSize())
+	<-done
+	if writeErr != nil {
+		return writeErr
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if expectedNodeID != 0 && frame.LocalNodeID != expectedNodeID {
+		return fmt.Errorf("handshake: expected node %d, got %d", expectedNodeID, frame.LocalNodeID)
+	}
+	conn.PeerNodeID = frame.LocalNodeID
+	conn.PeerRingVersion = frame.RingVersion
+	conn.MsgSize = frame.MaxMsgSize
+	if local := m.localMsgSize(); local < conn.MsgSize {
+		conn.MsgSize = local
+	}
+	if frame.RingVersion != ring.Version() {
+		if m.ringVersionMismatchHandler != nil {
+			m.ringVersionMismatchHandler(frame.LocalNodeID, frame.RingVersion, ring.Version())
+		}
+		// checkRingVersion can call MsgToNode, which dials through the same
+		// connPool - and handshake runs on the dial path, inside the
+		// dialFunc connPool.dial is already executing for this address.
+		// Calling it synchronously here would re-enter dial for an address
+		// it still holds in-flight, deadlocking the caller. Dispatch it off
+		// the hot path instead.
+		go m.checkRingVersion(frame.LocalNodeID, frame.RingVersion)
+	}
+	return nil
+}
+
+// addressMatchesRemote reports whether addr (a "host:port" as listed in the
+// ring) shares a host with remote, the address an accepted connection
+// actually came from. The port is ignored since outbound connections use an
+// ephemeral source port.
+func addressMatchesRemote(addr string, remote net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return false
+	}
+	return host == remoteHost
+}
@@ -0,0 +1,306 @@
+package ring
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Priority classes for multiplexed stream traffic. The writer goroutine
+// always prefers higher-priority queues, so small control messages (e.g.
+// ring pings) are not stuck behind large bulk transfers (e.g.
+// replica sync) sharing the same connection.
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityBulk
+	priorityCount // must stay last; used to size the queue table
+)
+
+// chunkFlagEOF marks the final chunk of a stream.
+const chunkFlagEOF byte = 1 << 0
+
+// queuedChunk is one chunk of a logical message, tagged with the stream it
+// belongs to and its position in that stream.
+type queuedChunk struct {
+	streamID uint32
+	seq      uint32
+	eof      bool
+	payload  []byte
+}
+
+// streamWriter chops everything written to it into DefaultChunksize frames
+// and hands them to the owning RingConn's single writer goroutine at a
+// fixed priority, so concurrent MsgToNode callers interleave fairly on one
+// TCP connection instead of serializing behind each other's writes.
+type streamWriter struct {
+	conn     *RingConn
+	streamID uint32
+	priority Priority
+	seq      uint32
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunkLen := len(p)
+		if chunkLen > DefaultChunksize {
+			chunkLen = DefaultChunksize
+		}
+		// Copy since p's backing array may be reused by the caller once
+		// Write returns, but the chunk is consumed asynchronously.
+		payload := make([]byte, chunkLen)
+		copy(payload, p[:chunkLen])
+		if err := w.conn.enqueueChunk(w.priority, queuedChunk{streamID: w.streamID, seq: w.seq, payload: payload}); err != nil {
+			return n, err
+		}
+		w.seq++
+		n += chunkLen
+		p = p[chunkLen:]
+	}
+	return n, nil
+}
+
+// Close emits the final, EOF-flagged chunk for this stream.
+func (w *streamWriter) Close() error {
+	return w.conn.enqueueChunk(w.priority, queuedChunk{streamID: w.streamID, seq: w.seq, eof: true})
+}
+
+// maxStreamQueueChunks bounds how many chunks enqueueChunk lets a single
+// stream buffer before blocking the caller, so one stream's writer can't
+// run unbounded ahead of a slow connection.
+const maxStreamQueueChunks = 64
+
+// streamQueue is one stream's pending outbound chunks, in send order.
+type streamQueue struct {
+	chunks []queuedChunk
+}
+
+// startMux initializes the per-connection state needed for multiplexing and
+// launches the single writer goroutine. Safe to call once per RingConn.
+func (c *RingConn) startMux() {
+	c.muxCond = sync.NewCond(&c.muxMu)
+	for i := range c.streamQueues {
+		c.streamQueues[i] = make(map[uint32]*streamQueue)
+	}
+	c.streams = make(map[uint32]*io.PipeWriter)
+	c.discardedStreams = make(map[uint32]struct{})
+	go c.writeLoop()
+}
+
+// newStream allocates a fresh stream ID and returns a writer for it at the
+// given priority.
+func (c *RingConn) newStream(priority Priority) *streamWriter {
+	streamID := atomic.AddUint32(&c.nextStreamID, 1)
+	return &streamWriter{conn: c, streamID: streamID, priority: priority}
+}
+
+// enqueueChunk appends ch to its stream's queue at the given priority,
+// registering the stream in that priority's round-robin rotation if this
+// is its first pending chunk. It blocks while that stream's queue is full,
+// so a fast writer can't grow a connection's buffered backlog without
+// bound, and returns io.ErrClosedPipe once the connection is closed.
+func (c *RingConn) enqueueChunk(priority Priority, ch queuedChunk) error {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	for {
+		select {
+		case <-c.closed():
+			return io.ErrClosedPipe
+		default:
+		}
+		q, ok := c.streamQueues[priority][ch.streamID]
+		if !ok {
+			q = &streamQueue{}
+			c.streamQueues[priority][ch.streamID] = q
+			c.streamOrder[priority] = append(c.streamOrder[priority], ch.streamID)
+		}
+		if len(q.chunks) < maxStreamQueueChunks {
+			q.chunks = append(q.chunks, ch)
+			c.muxCond.Broadcast()
+			return nil
+		}
+		c.muxCond.Wait()
+	}
+}
+
+func (c *RingConn) closed() chan struct{} {
+	c.chanOnce.Do(func() { c.closeCh = make(chan struct{}) })
+	return c.closeCh
+}
+
+// writeLoop is the single writer goroutine for this connection.
+func (c *RingConn) writeLoop() {
+	for {
+		ch, ok := c.nextChunk()
+		if !ok {
+			return
+		}
+		if err := c.writeChunk(ch); err != nil {
+			log.Println("ERR: Writing chunk -", err)
+			return
+		}
+	}
+}
+
+// nextChunk blocks until a chunk is ready to send, always preferring
+// PriorityHigh, then PriorityNormal, then PriorityBulk, so control traffic
+// can never be starved behind a long bulk transfer. Within a priority it
+// round-robins fairly among that priority's streams, one chunk per turn,
+// so a large message on one stream can't hold up another stream sharing
+// the same priority (unlike a single shared FIFO, where a burst from one
+// stream simply sits ahead of everything enqueued after it). It reports
+// false once the connection is closed and every queue has drained.
+func (c *RingConn) nextChunk() (queuedChunk, bool) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	for {
+		for p := PriorityHigh; p < priorityCount; p++ {
+			if ch, ok := c.popStreamChunkLocked(p); ok {
+				return ch, true
+			}
+		}
+		select {
+		case <-c.closed():
+			return queuedChunk{}, false
+		default:
+		}
+		c.muxCond.Wait()
+	}
+}
+
+// popStreamChunkLocked removes and returns the next chunk at priority p,
+// advancing p's round-robin cursor past the stream it came from, and
+// retiring that stream from the rotation once its EOF chunk is sent.
+// Callers must hold c.muxMu.
+func (c *RingConn) popStreamChunkLocked(p Priority) (queuedChunk, bool) {
+	order := c.streamOrder[p]
+	for i := 0; i < len(order); i++ {
+		idx := (c.streamCursor[p] + i) % len(order)
+		streamID := order[idx]
+		q := c.streamQueues[p][streamID]
+		if len(q.chunks) == 0 {
+			continue
+		}
+		ch := q.chunks[0]
+		q.chunks = q.chunks[1:]
+		c.streamCursor[p] = idx + 1
+		if ch.eof {
+			delete(c.streamQueues[p], streamID)
+			c.streamOrder[p] = append(order[:idx], order[idx+1:]...)
+			// The following stream has shifted into idx; start there next.
+			c.streamCursor[p] = idx
+		}
+		c.muxCond.Broadcast()
+		return ch, true
+	}
+	return queuedChunk{}, false
+}
+
+func (c *RingConn) writeChunk(ch queuedChunk) error {
+	c.Lock()
+	defer c.Unlock()
+	var hdr [13]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], ch.streamID)
+	binary.LittleEndian.PutUint32(hdr[4:8], ch.seq)
+	if ch.eof {
+		hdr[8] = chunkFlagEOF
+	}
+	binary.LittleEndian.PutUint32(hdr[9:13], uint32(len(ch.payload)))
+	if _, err := c.Writer.Write(hdr[:]); err != nil {
+		return err
+	}
+	if len(ch.payload) > 0 {
+		if _, err := c.Writer.Write(ch.payload); err != nil {
+			return err
+		}
+	}
+	if err := c.Writer.Flush(); err != nil {
+		return err
+	}
+	if c.pool != nil {
+		c.pool.touch(c.poolAddr)
+	}
+	return nil
+}
+
+// readChunk reads one chunk frame from r.
+func readChunk(r io.Reader) (queuedChunk, error) {
+	var hdr [13]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return queuedChunk{}, err
+	}
+	ch := queuedChunk{
+		streamID: binary.LittleEndian.Uint32(hdr[0:4]),
+		seq:      binary.LittleEndian.Uint32(hdr[4:8]),
+		eof:      hdr[8]&chunkFlagEOF != 0,
+	}
+	length := binary.LittleEndian.Uint32(hdr[9:13])
+	if length > 0 {
+		ch.payload = make([]byte, length)
+		if _, err := io.ReadFull(r, ch.payload); err != nil {
+			return queuedChunk{}, err
+		}
+	}
+	return ch, nil
+}
+
+// demux is the single reader goroutine's loop: it reads chunk frames off
+// conn and reassembles them by stream ID, handing each new stream's reader
+// side off to onStream (which dispatches the eventual complete message to
+// msgHandlers) and closing it when the EOF chunk arrives. A single stream
+// whose pipe write fails is dropped and skipped for the rest of its chunks
+// rather than tearing down the whole connection. A pipe write that blocks
+// is not timed out: demux waits until onStream reads the stream's bytes,
+// which is why onStream must drain every stream it is given. conn must
+// have had startMux called, which creates the stream maps used here.
+// onStream is also given conn's
+// negotiated msize, so it can reject a header claiming a body larger than
+// the handshake allowed before acting on it.
+func (m *TCPMsgRing) demux(conn *RingConn, onStream func(streamID uint32, peerNodeID uint64, msize uint64, r io.Reader)) error {
+	for {
+		ch, err := readChunk(conn.Reader)
+		if err != nil {
+			return err
+		}
+		if conn.pool != nil {
+			conn.pool.touch(conn.poolAddr)
+		}
+		conn.streamsMu.Lock()
+		if _, discarded := conn.discardedStreams[ch.streamID]; discarded {
+			if ch.eof {
+				delete(conn.discardedStreams, ch.streamID)
+			}
+			conn.streamsMu.Unlock()
+			continue
+		}
+		pw, ok := conn.streams[ch.streamID]
+		if !ok {
+			var pr *io.PipeReader
+			pr, pw = io.Pipe()
+			conn.streams[ch.streamID] = pw
+			go onStream(ch.streamID, conn.PeerNodeID, conn.MaxMsgLength(), pr)
+		}
+		conn.streamsMu.Unlock()
+		if len(ch.payload) > 0 {
+			if _, err := pw.Write(ch.payload); err != nil {
+				log.Println("ERR: demux: stream", ch.streamID, "-", err, "- dropping stream")
+				conn.streamsMu.Lock()
+				delete(conn.streams, ch.streamID)
+				conn.discardedStreams[ch.streamID] = struct{}{}
+				conn.streamsMu.Unlock()
+				continue
+			}
+		}
+		if ch.eof {
+			pw.Close()
+			conn.streamsMu.Lock()
+			delete(conn.streams, ch.streamID)
+			conn.streamsMu.Unlock()
+		}
+	}
+}
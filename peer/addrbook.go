@@ -0,0 +1,220 @@
+// Package peer maintains a persistent address book of known ring nodes,
+// patterned after Tendermint's addrbook.go: every address a node has ever
+// heard about for a peer is tracked in a "new" bucket until it has been
+// successfully dialed, at which point it is promoted to the "old" (verified)
+// bucket. Failing addresses accumulate a failure count used to back off
+// retries exponentially.
+package peer
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultBackoffBase is the base delay used to compute how long a failing
+// address should be avoided before it is retried again.
+var DefaultBackoffBase = 10 * time.Second
+
+// Addr is one address a node has been reachable at, along with the
+// bookkeeping needed to decide whether it's worth dialing right now.
+type Addr struct {
+	Address      string    `json:"address"`
+	Tier         string    `json:"tier,omitempty"`
+	LastSeen     time.Time `json:"last_seen"`
+	FailureCount int       `json:"failure_count"`
+	LastFailure  time.Time `json:"last_failure,omitempty"`
+}
+
+// Bad reports whether Addr failed recently enough that it should be skipped
+// in favor of an alternate, based on an exponential backoff of its
+// FailureCount.
+func (a *Addr) Bad(now time.Time) bool {
+	if a.FailureCount == 0 {
+		return false
+	}
+	backoff := time.Duration(math.Pow(2, float64(a.FailureCount-1))) * DefaultBackoffBase
+	return now.Before(a.LastFailure.Add(backoff))
+}
+
+// nodeEntry is the persisted, per-node state: addresses not yet confirmed
+// reachable ("new") and addresses that have been successfully dialed at
+// least once ("old"/verified).
+type nodeEntry struct {
+	NodeID uint64           `json:"node_id"`
+	New    map[string]*Addr `json:"new"`
+	Old    map[string]*Addr `json:"old"`
+}
+
+func newNodeEntry(nodeID uint64) *nodeEntry {
+	return &nodeEntry{
+		NodeID: nodeID,
+		New:    make(map[string]*Addr),
+		Old:    make(map[string]*Addr),
+	}
+}
+
+// AddrBook is a persistent, concurrency-safe store of known addresses for
+// every node in the ring, used to find an alternate when the ring's
+// configured address for a node can't be resolved or dialed.
+type AddrBook struct {
+	mu    sync.Mutex
+	path  string
+	nodes map[uint64]*nodeEntry
+}
+
+// NewAddrBook returns an AddrBook persisted as JSON at path. Call Load to
+// populate it from a previous run.
+func NewAddrBook(path string) *AddrBook {
+	return &AddrBook{
+		path:  path,
+		nodes: make(map[uint64]*nodeEntry),
+	}
+}
+
+// Load reads the address book from disk. A missing file is not an error -
+// it just means this is the first run.
+func (b *AddrBook) Load() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var nodes map[uint64]*nodeEntry
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return err
+	}
+	b.nodes = nodes
+	return nil
+}
+
+// Save writes the address book to disk as JSON. A book created with an
+// empty path is kept in memory only, and Save does nothing for it.
+func (b *AddrBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.path, data, 0644)
+}
+
+func (b *AddrBook) entry(nodeID uint64) *nodeEntry {
+	e, ok := b.nodes[nodeID]
+	if !ok {
+		e = newNodeEntry(nodeID)
+		b.nodes[nodeID] = e
+	}
+	return e
+}
+
+// AddAddress records address as a possible way to reach nodeID, if it isn't
+// already known. New addresses start in the "new" bucket until MarkGood
+// promotes them.
+func (b *AddrBook) AddAddress(nodeID uint64, address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.entry(nodeID)
+	if _, ok := e.Old[address]; ok {
+		return
+	}
+	if _, ok := e.New[address]; ok {
+		return
+	}
+	e.New[address] = &Addr{Address: address, LastSeen: time.Now()}
+}
+
+// MarkGood promotes address to the verified "old" bucket and resets its
+// failure count, following a successful dial.
+func (b *AddrBook) MarkGood(nodeID uint64, address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.entry(nodeID)
+	a, ok := e.New[address]
+	if !ok {
+		a, ok = e.Old[address]
+	}
+	if !ok {
+		a = &Addr{Address: address}
+	}
+	a.LastSeen = time.Now()
+	a.FailureCount = 0
+	delete(e.New, address)
+	e.Old[address] = a
+}
+
+// MarkBad records a failed dial of address, growing its exponential
+// backoff so KnownAddresses deprioritizes it until the backoff elapses.
+func (b *AddrBook) MarkBad(nodeID uint64, address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.entry(nodeID)
+	a, ok := e.Old[address]
+	if !ok {
+		a, ok = e.New[address]
+	}
+	if !ok {
+		a = &Addr{Address: address}
+		e.New[address] = a
+	}
+	a.FailureCount++
+	a.LastFailure = time.Now()
+}
+
+// KnownAddresses returns the addresses known for nodeID, verified ("old")
+// addresses first, with any address currently backed off after repeated
+// failures filtered out.
+func (b *AddrBook) KnownAddresses(nodeID uint64) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	var addrs []string
+	for _, a := range e.Old {
+		if !a.Bad(now) {
+			addrs = append(addrs, a.Address)
+		}
+	}
+	for _, a := range e.New {
+		if !a.Bad(now) {
+			addrs = append(addrs, a.Address)
+		}
+	}
+	return addrs
+}
+
+// Sample returns up to n (nodeID, address) pairs drawn from the verified
+// ("old") addresses in the address book, for answering a peer-exchange
+// request; addresses still in the "new" bucket are not included. It isn't
+// cryptographically random - map iteration order is Go's usual
+// unspecified-but-shuffled order, which is good enough for spreading
+// addresses around the mesh.
+func (b *AddrBook) Sample(n int) map[uint64][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sample := make(map[uint64][]string)
+	count := 0
+	for nodeID, e := range b.nodes {
+		for _, a := range e.Old {
+			sample[nodeID] = append(sample[nodeID], a.Address)
+			count++
+			if count >= n {
+				return sample
+			}
+		}
+	}
+	return sample
+}
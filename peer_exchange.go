@@ -0,0 +1,200 @@
+package ring
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/caihuanong/ring/peer"
+)
+
+// Reserved message types for the ring package's own control-plane traffic.
+// Applications registering handlers via SetMsgHandler should avoid this
+// range.
+const (
+	MsgTypePeerExchangeRequest uint64 = iota + msgTypeReservedBase
+	MsgTypePeerExchangeResponse
+)
+
+const msgTypeReservedBase uint64 = 1<<64 - 1<<16
+
+// DefaultPeerExchangeInterval is how often a node asks a random known peer
+// for a sample of the addresses it knows about.
+var DefaultPeerExchangeInterval = 5 * time.Minute
+
+// DefaultPeerExchangeSampleSize bounds how many addresses are returned in
+// response to a peer-exchange request.
+var DefaultPeerExchangeSampleSize = 50
+
+// SetAddrBookPath points the address book at a JSON file to persist to and
+// load from between restarts, and loads it immediately.
+func (m *TCPMsgRing) SetAddrBookPath(path string) error {
+	m.addrBook = peer.NewAddrBook(path)
+	return m.addrBook.Load()
+}
+
+func (m *TCPMsgRing) ensureAddrBook() *peer.AddrBook {
+	if m.addrBook == nil {
+		m.addrBook = peer.NewAddrBook("")
+	}
+	return m.addrBook
+}
+
+// AddPeerAddress records an alternate address for nodeID in the address
+// book, to be tried if the ring's configured address for that node can't be
+// resolved or dialed.
+func (m *TCPMsgRing) AddPeerAddress(nodeID uint64, address string) {
+	m.ensureAddrBook().AddAddress(nodeID, address)
+}
+
+// KnownAddresses returns the addresses the address book has recorded for
+// nodeID, verified ones first. Addresses currently backed off after dial
+// failures are left out.
+func (m *TCPMsgRing) KnownAddresses(nodeID uint64) []string {
+	return m.ensureAddrBook().KnownAddresses(nodeID)
+}
+
+// SaveAddrBook persists the address book to the path given to
+// SetAddrBookPath. A no-op if that was never called.
+func (m *TCPMsgRing) SaveAddrBook() error {
+	if m.addrBook == nil {
+		return nil
+	}
+	return m.addrBook.Save()
+}
+
+// dialWithAlternates dials primary, the address the ring has configured for
+// nodeID. If that fails, it marks primary bad in the address book and works
+// through any alternates KnownAddresses has recorded for nodeID until one
+// succeeds. The address that was actually connected to is marked good in
+// the address book and returned; the connection pool stays keyed by
+// primary, so later lookups by the ring's address find this connection.
+func (m *TCPMsgRing) dialWithAlternates(nodeID uint64, primary string) (net.Conn, string, error) {
+	addrs := append([]string{primary}, m.KnownAddresses(nodeID)...)
+	var lastErr error
+	for _, addr := range addrs {
+		tcpconn, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+		if err != nil {
+			m.ensureAddrBook().MarkBad(nodeID, addr)
+			lastErr = err
+			continue
+		}
+		m.ensureAddrBook().MarkGood(nodeID, addr)
+		return tcpconn, addr, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses known for node %d", nodeID)
+	}
+	return nil, "", lastErr
+}
+
+// StartPeerExchange registers the peer-exchange message handlers and
+// launches a goroutine that periodically asks a random known node for a
+// sample of the addresses it knows about, merging the responses into the
+// local address book.
+func (m *TCPMsgRing) StartPeerExchange(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPeerExchangeInterval
+	}
+	m.ensureAddrBook()
+	m.internalHandlers[MsgTypePeerExchangeRequest] = m.handlePeerExchangeRequest
+	m.internalHandlers[MsgTypePeerExchangeResponse] = m.handlePeerExchangeResponse
+	go m.peerExchangeLoop(interval)
+}
+
+func (m *TCPMsgRing) peerExchangeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		peerID := m.randomKnownNodeID()
+		if peerID == 0 {
+			continue
+		}
+		m.MsgToNode(peerID, &peerExchangeRequestMsg{})
+	}
+}
+
+// randomKnownNodeID picks a random node ID from the address book's Sample,
+// so only nodes with at least one verified ("old") address are candidates.
+// It is used as the target for a periodic peer-exchange request.
+func (m *TCPMsgRing) randomKnownNodeID() uint64 {
+	sample := m.ensureAddrBook().Sample(64)
+	if len(sample) == 0 {
+		return 0
+	}
+	ids := make([]uint64, 0, len(sample))
+	for id := range sample {
+		ids = append(ids, id)
+	}
+	return ids[rand.Intn(len(ids))]
+}
+
+func (m *TCPMsgRing) handlePeerExchangeRequest(peerNodeID uint64, r io.Reader, length uint64) (uint64, error) {
+	if length > 0 {
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return 0, err
+		}
+	}
+	sample := m.ensureAddrBook().Sample(DefaultPeerExchangeSampleSize)
+	resp, err := newPeerExchangeResponseMsg(sample)
+	if err != nil {
+		log.Println("ERR: Building peer-exchange response -", err)
+		return length, nil
+	}
+	m.MsgToNode(peerNodeID, resp)
+	return length, nil
+}
+
+func (m *TCPMsgRing) handlePeerExchangeResponse(peerNodeID uint64, r io.Reader, length uint64) (uint64, error) {
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	var sample map[uint64][]string
+	if err := json.Unmarshal(body, &sample); err != nil {
+		log.Println("ERR: Decoding peer-exchange response from", peerNodeID, "-", err)
+		return length, nil
+	}
+	book := m.ensureAddrBook()
+	for nodeID, addrs := range sample {
+		for _, addr := range addrs {
+			book.AddAddress(nodeID, addr)
+		}
+	}
+	return length, nil
+}
+
+// peerExchangeRequestMsg is an empty request for a sample of the
+// responder's known addresses.
+type peerExchangeRequestMsg struct{}
+
+func (peerExchangeRequestMsg) MsgType() uint64                          { return MsgTypePeerExchangeRequest }
+func (peerExchangeRequestMsg) MsgLength() uint64                        { return 0 }
+func (peerExchangeRequestMsg) WriteContent(w io.Writer) (uint64, error) { return 0, nil }
+func (peerExchangeRequestMsg) Done()                                    {}
+
+// peerExchangeResponseMsg carries a JSON-encoded sample of (nodeID,
+// addresses) pairs from the responder's address book.
+type peerExchangeResponseMsg struct {
+	body []byte
+}
+
+func newPeerExchangeResponseMsg(sample map[uint64][]string) (*peerExchangeResponseMsg, error) {
+	body, err := json.Marshal(sample)
+	if err != nil {
+		return nil, err
+	}
+	return &peerExchangeResponseMsg{body: body}, nil
+}
+
+func (m *peerExchangeResponseMsg) MsgType() uint64   { return MsgTypePeerExchangeResponse }
+func (m *peerExchangeResponseMsg) MsgLength() uint64 { return uint64(len(m.body)) }
+func (m *peerExchangeResponseMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(m.body)
+	return uint64(n), err
+}
+func (m *peerExchangeResponseMsg) Done() {}
@@ -0,0 +1,274 @@
+package ring
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+// Reserved message types for ring-version exchange and pull-on-demand ring
+// updates, continuing the range started in peer_exchange.go.
+const (
+	MsgTypeRingVersionPing uint64 = iota + msgTypeReservedBase + 16
+	MsgTypeRingPullRequest
+	MsgTypeRingPullResponse
+	MsgTypeRingObsolete
+)
+
+// DefaultRingVersionPingInterval is how often a node pings its connected
+// peers with its current ring version, when StartRingVersionSync is used.
+var DefaultRingVersionPingInterval = time.Minute
+
+// RingUpdater is called with a ring pulled from a peer reporting a higher
+// Version() than the local node's. Implementations should atomically
+// replace whatever ring the rest of the application is using - e.g. by
+// calling TCPMsgRing.SetRing - so Responsible/ResponsibleIDs calls already
+// in flight never see a torn update.
+type RingUpdater func(newRing Ring)
+
+// SetRingUpdater sets the callback invoked when a newer ring has been
+// pulled from a peer. Without one, TCPMsgRing installs the pulled ring
+// itself via SetRing.
+func (m *TCPMsgRing) SetRingUpdater(updater RingUpdater) {
+	m.ringUpdater = updater
+}
+
+// SetRing atomically replaces the ring TCPMsgRing uses for routing and
+// version comparisons. Application RingUpdater callbacks should call this
+// (directly or indirectly) once they've finished applying a pulled ring.
+func (m *TCPMsgRing) SetRing(r Ring) {
+	m.ringMu.Lock()
+	m.ring = r
+	m.ringMu.Unlock()
+}
+
+// ringVersionPingBody is the payload of a RingVersionPing: just enough for
+// the receiver to decide whether it's behind, ahead, or caught up, without
+// shipping the whole ring on every ping.
+type ringVersionPingBody struct {
+	Version           int64  `json:"version"`
+	PartitionBitCount uint16 `json:"partition_bit_count"`
+	ReplicaCount      int    `json:"replica_count"`
+}
+
+// ringBlob is a serialized *ringImpl, minus the locally-meaningful
+// localNodeIndex - each recipient looks its own node up in NodeIDs instead.
+type ringBlob struct {
+	Version                       int64     `json:"version"`
+	PartitionBitCount             uint16    `json:"partition_bit_count"`
+	NodeIDs                       []uint64  `json:"node_ids"`
+	ReplicaToPartitionToNodeIndex [][]int32 `json:"replica_to_partition_to_node_index"`
+}
+
+func ringToBlob(r Ring) (ringBlob, bool) {
+	impl, ok := r.(*ringImpl)
+	if !ok {
+		return ringBlob{}, false
+	}
+	return ringBlob{
+		Version:                       impl.version,
+		PartitionBitCount:             impl.partitionBitCount,
+		NodeIDs:                       impl.nodeIDs,
+		ReplicaToPartitionToNodeIndex: impl.replicaToPartitionToNodeIndex,
+	}, true
+}
+
+// ringFromBlob reconstructs a ring for the local node from a pulled blob,
+// locating localNodeID within the blob's NodeIDs to fill in the
+// locally-meaningful localNodeIndex.
+func ringFromBlob(blob ringBlob, localNodeID uint64) *ringImpl {
+	var localNodeIndex int32
+	for i, id := range blob.NodeIDs {
+		if id == localNodeID {
+			localNodeIndex = int32(i)
+			break
+		}
+	}
+	return &ringImpl{
+		version:                       blob.Version,
+		localNodeIndex:                localNodeIndex,
+		partitionBitCount:             blob.PartitionBitCount,
+		nodeIDs:                       blob.NodeIDs,
+		replicaToPartitionToNodeIndex: blob.ReplicaToPartitionToNodeIndex,
+	}
+}
+
+// StartRingVersionSync registers the ring-sync message handlers and
+// launches a goroutine that periodically pings every connected peer with
+// the local ring version, so version skew is noticed even on connections
+// that otherwise sit idle.
+func (m *TCPMsgRing) StartRingVersionSync(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultRingVersionPingInterval
+	}
+	m.internalHandlers[MsgTypeRingVersionPing] = m.handleRingVersionPing
+	m.internalHandlers[MsgTypeRingPullRequest] = m.handleRingPullRequest
+	m.internalHandlers[MsgTypeRingPullResponse] = m.handleRingPullResponse
+	m.internalHandlers[MsgTypeRingObsolete] = m.handleRingObsolete
+	go m.ringVersionPingLoop(interval)
+}
+
+func (m *TCPMsgRing) ringVersionPingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, conn := range m.pool.snapshot() {
+			if conn.PeerNodeID != 0 {
+				m.MsgToNode(conn.PeerNodeID, newRingVersionPingMsg(m.currentRing()))
+			}
+		}
+	}
+}
+
+// checkRingVersion compares a peer's reported ring version against the
+// local one immediately after a handshake and acts the same way a
+// RingVersionPing would: a strictly newer peer triggers a pull request, a
+// strictly older one gets told its ring is obsolete so it can pull from us.
+func (m *TCPMsgRing) checkRingVersion(peerNodeID uint64, peerVersion int64) {
+	localVersion := m.currentRing().Version()
+	switch {
+	case peerVersion > localVersion:
+		m.MsgToNode(peerNodeID, &ringPullRequestMsg{})
+	case peerVersion < localVersion:
+		m.MsgToNode(peerNodeID, &ringObsoleteMsg{})
+	}
+}
+
+func (m *TCPMsgRing) handleRingVersionPing(peerNodeID uint64, r io.Reader, length uint64) (uint64, error) {
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	var ping ringVersionPingBody
+	if err := json.Unmarshal(body, &ping); err != nil {
+		log.Println("ERR: Decoding ring version ping from", peerNodeID, "-", err)
+		return length, nil
+	}
+	m.checkRingVersion(peerNodeID, ping.Version)
+	return length, nil
+}
+
+func (m *TCPMsgRing) handleRingPullRequest(peerNodeID uint64, r io.Reader, length uint64) (uint64, error) {
+	if length > 0 {
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return 0, err
+		}
+	}
+	blob, ok := ringToBlob(m.currentRing())
+	if !ok {
+		log.Println("ERR: Can't serialize local ring for pull request from", peerNodeID)
+		return length, nil
+	}
+	resp, err := newRingPullResponseMsg(blob)
+	if err != nil {
+		log.Println("ERR: Building ring pull response -", err)
+		return length, nil
+	}
+	m.MsgToNode(peerNodeID, resp)
+	return length, nil
+}
+
+func (m *TCPMsgRing) handleRingPullResponse(peerNodeID uint64, r io.Reader, length uint64) (uint64, error) {
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	var blob ringBlob
+	if err := json.Unmarshal(body, &blob); err != nil {
+		log.Println("ERR: Decoding ring pull response from", peerNodeID, "-", err)
+		return length, nil
+	}
+	localRing := m.currentRing()
+	if blob.Version <= localRing.Version() {
+		// A stale or hostile peer could answer a pull request with a ring
+		// no newer than (or equal to) the one we already have; installing
+		// it unconditionally would let that peer downgrade the live ring.
+		log.Println("ERR: Ignoring ring pull response from", peerNodeID, "- version", blob.Version, "<= local version", localRing.Version())
+		return length, nil
+	}
+	newRing := ringFromBlob(blob, localRing.LocalNodeID())
+	if m.ringUpdater != nil {
+		m.ringUpdater(newRing)
+	} else {
+		m.SetRing(newRing)
+	}
+	return length, nil
+}
+
+func (m *TCPMsgRing) handleRingObsolete(peerNodeID uint64, r io.Reader, length uint64) (uint64, error) {
+	if length > 0 {
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return 0, err
+		}
+	}
+	m.MsgToNode(peerNodeID, &ringPullRequestMsg{})
+	return length, nil
+}
+
+// ringPullRequestMsg is an empty request for the responder's current ring.
+type ringPullRequestMsg struct{}
+
+func (ringPullRequestMsg) MsgType() uint64                          { return MsgTypeRingPullRequest }
+func (ringPullRequestMsg) MsgLength() uint64                        { return 0 }
+func (ringPullRequestMsg) WriteContent(w io.Writer) (uint64, error) { return 0, nil }
+func (ringPullRequestMsg) Done()                                    {}
+
+// ringObsoleteMsg tells the recipient that its last-advertised ring version
+// is behind ours, so it should send a ringPullRequestMsg.
+type ringObsoleteMsg struct{}
+
+func (ringObsoleteMsg) MsgType() uint64                          { return MsgTypeRingObsolete }
+func (ringObsoleteMsg) MsgLength() uint64                        { return 0 }
+func (ringObsoleteMsg) WriteContent(w io.Writer) (uint64, error) { return 0, nil }
+func (ringObsoleteMsg) Done()                                    {}
+
+// ringVersionPingMsg carries just enough of the local ring's shape for the
+// recipient to decide whether it needs to pull.
+type ringVersionPingMsg struct {
+	body []byte
+}
+
+func newRingVersionPingMsg(r Ring) *ringVersionPingMsg {
+	body, err := json.Marshal(ringVersionPingBody{
+		Version:           r.Version(),
+		PartitionBitCount: r.PartitionBitCount(),
+		ReplicaCount:      r.ReplicaCount(),
+	})
+	if err != nil {
+		// Version/PartitionBitCount/ReplicaCount are all plain numbers, so
+		// this can't actually fail; keep the zero-value ping rather than
+		// propagating an error through a constructor nobody expects to fail.
+		log.Println("ERR: Encoding ring version ping -", err)
+	}
+	return &ringVersionPingMsg{body: body}
+}
+
+func (m *ringVersionPingMsg) MsgType() uint64   { return MsgTypeRingVersionPing }
+func (m *ringVersionPingMsg) MsgLength() uint64 { return uint64(len(m.body)) }
+func (m *ringVersionPingMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(m.body)
+	return uint64(n), err
+}
+func (m *ringVersionPingMsg) Done() {}
+
+// ringPullResponseMsg carries a JSON-encoded ringBlob.
+type ringPullResponseMsg struct {
+	body []byte
+}
+
+func newRingPullResponseMsg(blob ringBlob) (*ringPullResponseMsg, error) {
+	body, err := json.Marshal(blob)
+	if err != nil {
+		return nil, err
+	}
+	return &ringPullResponseMsg{body: body}, nil
+}
+
+func (m *ringPullResponseMsg) MsgType() uint64   { return MsgTypeRingPullResponse }
+func (m *ringPullResponseMsg) MsgLength() uint64 { return uint64(len(m.body)) }
+func (m *ringPullResponseMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(m.body)
+	return uint64(n), err
+}
+func (m *ringPullResponseMsg) Done() {}
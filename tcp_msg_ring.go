@@ -1,13 +1,14 @@
 package ring
 
 import (
-	"encoding/binary"
-	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/caihuanong/ring/peer"
 )
 
 var (
@@ -22,43 +23,191 @@ const (
 type RingConn struct {
 	Conn   net.Conn
 	Writer *TimeoutWriter
+	// Reader is the single TimeoutReader for this connection, shared by the
+	// handshake and demux so neither stage can strand bytes the other
+	// buffered ahead of where it stopped reading.
+	Reader *TimeoutReader
 	sync.Mutex
+	// PeerNodeID is the NodeID the peer reported during the handshake.
+	PeerNodeID uint64
+	// PeerRingVersion is the ring Version() the peer reported during the
+	// handshake.
+	PeerRingVersion int64
+	// MsgSize is the negotiated msize for this connection: the lesser of
+	// the two msizes proposed by either side during the handshake. It is
+	// zero until the handshake completes.
+	MsgSize uint64
+
+	// muxMu and muxCond guard and signal streamQueues/streamOrder below.
+	// A condition variable - rather than a channel per stream - lets
+	// writeLoop block until any stream at any priority becomes ready
+	// without a dynamic select over a variable set of channels.
+	muxMu   sync.Mutex
+	muxCond *sync.Cond
+	// streamQueues holds each priority's active outgoing streams, keyed by
+	// stream ID, and streamOrder is that priority's round-robin visiting
+	// order; streamCursor is where the next scan starts. Indexed by
+	// Priority. Together these let the writer goroutine started by
+	// startMux round-robin fairly among streams sharing a priority instead
+	// of serializing them through one FIFO.
+	streamQueues [priorityCount]map[uint32]*streamQueue
+	streamOrder  [priorityCount][]uint32
+	streamCursor [priorityCount]int
+	// nextStreamID hands out unique stream IDs for outgoing messages.
+	nextStreamID uint32
+	// streams holds the reassembly pipe for each in-flight incoming
+	// stream, keyed by stream ID.
+	streamsMu sync.Mutex
+	streams   map[uint32]*io.PipeWriter
+	// discardedStreams marks stream IDs demux gave up on after a failed
+	// pipe write, so it silently drops the rest of that stream's chunks
+	// instead of mistaking the next one for the start of a new stream.
+	discardedStreams map[uint32]struct{}
+
+	chanOnce  sync.Once // guards lazy creation of closeCh
+	closeOnce sync.Once // guards closing closeCh
+	closeCh   chan struct{}
+
+	// pool and poolAddr are set once this connection is stored in a
+	// connPool, so Close can notify the pool to drop its entry.
+	pool     *connPool
+	poolAddr string
 }
 
 func NewRingConn(conn net.Conn) *RingConn {
 	return &RingConn{
 		Conn:   conn,
 		Writer: NewTimeoutWriter(conn),
+		Reader: NewTimeoutReader(conn),
+	}
+}
+
+// Close closes the underlying connection, stops this RingConn's writer
+// goroutine if started, and - if this connection came from a connPool -
+// removes its entry so a later dial to the same address doesn't get handed
+// back a dead connection.
+func (c *RingConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed())
+		// Wake anything blocked in enqueueChunk or nextChunk so it can
+		// observe the close instead of waiting on a cond that nothing
+		// will signal again.
+		c.muxMu.Lock()
+		if c.muxCond != nil {
+			c.muxCond.Broadcast()
+		}
+		c.muxMu.Unlock()
+	})
+	if c.pool != nil {
+		c.pool.remove(c.poolAddr)
+	}
+	return c.Conn.Close()
+}
+
+// MaxMsgLength returns the negotiated msize for this connection, or
+// DefaultMsgSize if the handshake has not yet completed.
+func (c *RingConn) MaxMsgLength() uint64 {
+	if c.MsgSize == 0 {
+		return DefaultMsgSize
 	}
+	return c.MsgSize
 }
 
 type TCPMsgRing struct {
-	ring        *Ring
-	msgHandlers map[uint64]MsgUnmarshaller
-	conns       map[string]*RingConn
-	AddressIdx  uint // Set this to use a different node address
+	// ringMu guards ring so SetRing can swap it out while
+	// ringVersionPingLoop, msgToNode, handshake, etc. read it
+	// concurrently; reads must go through currentRing rather than the
+	// field directly.
+	ringMu                     sync.RWMutex
+	ring                       Ring
+	msgHandlers                map[uint64]MsgUnmarshaller
+	pool                       *connPool
+	AddressIdx                 uint // Set this to use a different node address
+	msgSize                    uint64
+	ringVersionMismatchHandler func(peerNodeID uint64, peerRingVersion int64, localRingVersion int64)
+	// Encrypt, when true, wraps every connection in an authenticated
+	// encryption layer (see secret_connection.go) using Keys to identify
+	// the local node and verify peers. Set via NewTCPMsgRingWithTLS.
+	Encrypt bool
+	Keys    NodeKeyProvider
+	// Codec encodes/decodes the msgType+length header preceding every
+	// message body. Defaults to BinaryCodec, the original v00002 format.
+	Codec Codec
+	// internalHandlers dispatches the ring package's own control message
+	// types (peer exchange, ring-version sync, ...), which need the
+	// sending peer's NodeID that the public MsgUnmarshaller signature
+	// doesn't carry.
+	internalHandlers map[uint64]internalMsgHandler
+	addrBook         *peer.AddrBook
+	ringUpdater      RingUpdater
 }
 
-func NewTCPMsgRing(r *Ring) *TCPMsgRing {
+// internalMsgHandler is like MsgUnmarshaller but also receives the NodeID
+// of the peer that sent the message, for control messages that need to
+// reply to or update state about a specific node.
+type internalMsgHandler func(peerNodeID uint64, r io.Reader, length uint64) (uint64, error)
+
+func NewTCPMsgRing(r Ring) *TCPMsgRing {
 	return &TCPMsgRing{
-		ring:        r,
-		msgHandlers: make(map[uint64]MsgUnmarshaller),
-		conns:       make(map[string]*RingConn),
-		AddressIdx:  DefaultAddress,
+		ring:             r,
+		msgHandlers:      make(map[uint64]MsgUnmarshaller),
+		pool:             newConnPool(),
+		AddressIdx:       DefaultAddress,
+		Codec:            BinaryCodec{},
+		internalHandlers: make(map[uint64]internalMsgHandler),
 	}
 }
 
-func (m *TCPMsgRing) Ring() *Ring {
+// StartConnectionReaper launches a goroutine that periodically closes and
+// removes connections that have carried no traffic for ttl, so a peer that
+// vanishes without a clean TCP close doesn't pin a dead connection (and its
+// goroutines) forever. ttl and interval default to DefaultIdleTTL and
+// DefaultReaperInterval when zero.
+func (m *TCPMsgRing) StartConnectionReaper(ttl, interval time.Duration) {
+	m.pool.startReaper(ttl, interval)
+}
+
+// NewTCPMsgRingWithTLS returns a TCPMsgRing that encrypts and authenticates
+// every connection using the secret-connection scheme, identifying the
+// local node and verifying peers via keys.
+func NewTCPMsgRingWithTLS(r Ring, keys NodeKeyProvider) *TCPMsgRing {
+	m := NewTCPMsgRing(r)
+	m.Encrypt = true
+	m.Keys = keys
+	return m
+}
+
+// currentRing returns the ring TCPMsgRing is currently routing with. It's
+// synchronized against SetRing so concurrent callers never observe a torn
+// interface value mid-swap; every read of the current ring should go
+// through this instead of the ring field directly.
+func (m *TCPMsgRing) currentRing() Ring {
+	m.ringMu.RLock()
+	defer m.ringMu.RUnlock()
 	return m.ring
 }
 
+func (m *TCPMsgRing) Ring() Ring {
+	return m.currentRing()
+}
+
 func (m *TCPMsgRing) GetNodesForPart(ringVersion int64, partition uint32) []uint64 {
 	// Just a dummy function for now
 	return []uint64{uint64(1), uint64(2)}
 }
 
-func (m *TCPMsgRing) MaxMsgLength() uint64 {
-	return math.MaxUint64
+// MaxMsgLength returns the negotiated msize for the connection to nodeID, or
+// DefaultMsgSize if there is no connection to that node yet.
+func (m *TCPMsgRing) MaxMsgLength(nodeID uint64) uint64 {
+	n := m.currentRing().Node(nodeID)
+	if n == nil {
+		return DefaultMsgSize
+	}
+	conn, ok := m.pool.get(n.Addresses[m.AddressIdx])
+	if !ok {
+		return DefaultMsgSize
+	}
+	return conn.MaxMsgLength()
 }
 
 func (m *TCPMsgRing) SetMsgHandler(msgType uint64, handler MsgUnmarshaller) {
@@ -66,52 +215,101 @@ func (m *TCPMsgRing) SetMsgHandler(msgType uint64, handler MsgUnmarshaller) {
 }
 
 func (m *TCPMsgRing) MsgToNode(nodeID uint64, msg Msg) {
-	m.msgToNode(nodeID, msg)
+	m.msgToNode(nodeID, msg, PriorityNormal)
 	msg.Done()
 }
 
-func (m *TCPMsgRing) msgToNode(nodeID uint64, msg Msg) {
+// MsgToNodeWithPriority is like MsgToNode but lets the caller mark bulk
+// transfers (e.g. replica sync) as low priority so they can't starve
+// control traffic sharing the same connection.
+func (m *TCPMsgRing) MsgToNodeWithPriority(nodeID uint64, msg Msg, priority Priority) {
+	m.msgToNode(nodeID, msg, priority)
+	msg.Done()
+}
+
+// dialAndHandshake dials nodeID - trying the ring's configured address and
+// any alternates the address book knows about - secures and multiplexes the
+// resulting connection, and performs the ring handshake. It's passed to
+// connPool.dial as the coalesced dial function for msgToNode, so concurrent
+// callers targeting the same address share a single dial attempt.
+func (m *TCPMsgRing) dialAndHandshake(nodeID uint64) (*RingConn, error) {
+	ring := m.currentRing()
+	n := ring.Node(nodeID)
+	if n == nil {
+		return nil, fmt.Errorf("no such node %d", nodeID)
+	}
+	tcpconn, addr, err := m.dialWithAlternates(nodeID, n.Addresses[m.AddressIdx])
+	if err != nil {
+		return nil, err
+	}
+	var wireConn net.Conn = tcpconn
+	if m.Encrypt {
+		_, wireConn, err = newSecretConnection(tcpconn, m.Keys, ring.LocalNodeID(), nodeID, 0)
+		if err != nil {
+			tcpconn.Close()
+			return nil, fmt.Errorf("securing connection to %s: %w", addr, err)
+		}
+	}
+	conn := NewRingConn(wireConn)
+	if err := m.handshake(conn, nodeID); err != nil {
+		conn.Conn.Close()
+		return nil, fmt.Errorf("handshake with %s: %w", addr, err)
+	}
+	conn.startMux()
+	go func() {
+		err := m.demux(conn, m.handleStream)
+		log.Println("Closing connection to", addr, "-", err)
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+func (m *TCPMsgRing) msgToNode(nodeID uint64, msg Msg, priority Priority) {
 	// TODO: Add retry functionality
-	n := m.ring.Node(nodeID)
+	n := m.currentRing().Node(nodeID)
 	if n == nil {
 		return
 	}
 	// See if we have a connection already
 	// TODO: This whole thing should be configurable to use a given "slot" in
 	// the Addresses list.
-	conn, ok := m.conns[n.Addresses[m.AddressIdx]]
+	addr := n.Addresses[m.AddressIdx]
+	if m.pool.circuitOpen(addr) {
+		log.Println("ERR: Circuit open for", addr, "- skipping dial")
+		return
+	}
+	conn, ok := m.pool.get(addr)
 	if !ok {
-		// We need to open a connection
-		// TODO: Handle connection timeouts
-		tcpconn, err := net.DialTimeout("tcp", n.Addresses[m.AddressIdx], DefaultTimeout)
+		var err error
+		conn, err = m.pool.dial(addr, func() (*RingConn, error) {
+			return m.dialAndHandshake(nodeID)
+		})
 		if err != nil {
-			log.Println("ERR: Trying to connect to", n.Addresses[m.AddressIdx], err)
+			log.Println("ERR: Trying to connect to", addr, err)
 			return
 		}
-		conn := NewRingConn(tcpconn)
-		m.conns[n.Addresses[m.AddressIdx]] = conn
-	}
-	conn.Lock() // Make sure we only have one writer at a time
-	// TODO: Handle write timeouts
-	// write the msg type
-	msgType := msg.MsgType()
-	for i := uint(0); i <= 56; i += 8 {
-		_ = conn.Writer.WriteByte(byte(msgType >> i))
-	}
-	// Write the msg size
-	msgLength := msg.MsgLength()
-	for i := uint(0); i <= 56; i += 8 {
-		_ = conn.Writer.WriteByte(byte(msgLength >> i))
-	}
-	// Write the msg
-	length, err := msg.WriteContent(conn.Writer)
-	// Make sure we flush the data
-	conn.Writer.Flush()
-	conn.Unlock()
+	}
+	if msg.MsgLength() > conn.MaxMsgLength() {
+		log.Println("ERR: Message length", msg.MsgLength(), "exceeds negotiated msize", conn.MaxMsgLength(), "for", n.Addresses[m.AddressIdx])
+		return
+	}
+	// Each message gets its own stream so it can be chunked and
+	// interleaved fairly with other concurrent MsgToNode calls instead of
+	// holding the connection for the whole write.
+	stream := conn.newStream(priority)
+	if err := m.Codec.EncodeHeader(stream, msg.MsgType(), msg.MsgLength()); err != nil {
+		log.Println("ERR: Writing msg header -", err)
+		return
+	}
+	length, err := msg.WriteContent(stream)
 	if err != nil {
 		log.Println("ERR: Sending content - ", err)
 		return
 	}
+	if err := stream.Close(); err != nil {
+		log.Println("ERR: Closing stream -", err)
+		return
+	}
 	if length != msg.MsgLength() {
 		log.Println("ERR: Didn't send enough data", length, msg.MsgLength())
 		return
@@ -119,7 +317,7 @@ func (m *TCPMsgRing) msgToNode(nodeID uint64, msg Msg) {
 }
 
 func (m *TCPMsgRing) MsgToNodeChan(nodeID uint64, msg Msg, retchan chan struct{}) {
-	m.msgToNode(nodeID, msg)
+	m.msgToNode(nodeID, msg, PriorityNormal)
 	retchan <- struct{}{}
 }
 
@@ -136,51 +334,84 @@ func (m *TCPMsgRing) MsgToOtherReplicas(ringVersion int64, partition uint32, msg
 }
 
 func (m *TCPMsgRing) handle(conn net.Conn) error {
-	reader := NewTimeoutReader(conn)
-	var length uint64
-	var msgType uint64
-	for {
-		// for v.00002 we will store this in the fist 8 bytes
-		err := binary.Read(reader, binary.LittleEndian, &msgType)
-		if err != nil {
-			log.Println("Closing connection")
-			conn.Close()
-			return err
-		}
-		handle, ok := m.msgHandlers[msgType]
-		if !ok {
-			log.Println("ERR: Unknown message type", msgType)
-			// TODO: Handle errors better
-			log.Println("Closing connection")
-			conn.Close()
-			return errors.New("Unknown message type")
-		}
-		// for v.00002 the msg length will be the next 8 bytes
-		err = binary.Read(reader, binary.LittleEndian, &length)
-		if err != nil {
-			log.Println("ERR: Error reading length")
-			// TODO: Handle errors better
-			log.Println("Closing connection")
-			conn.Close()
-			return err
-		}
-		// attempt to handle the message
-		consumed, err := handle(reader, length)
+	if m.Encrypt {
+		_, securedConn, err := newSecretConnection(conn, m.Keys, m.currentRing().LocalNodeID(), 0, 0)
 		if err != nil {
-			log.Println("ERR: Error handling message", err)
-			// TODO: Handle errors better
-			log.Println("Closing connection")
+			log.Println("ERR: Securing connection from", conn.RemoteAddr(), err)
 			conn.Close()
 			return err
 		}
-		if consumed != length {
-			log.Println("ERR: Didn't consume whole message", length, consumed)
-			// TODO: Handle errors better
-			log.Println("Closing connection")
+		conn = securedConn
+	}
+	ringConn := NewRingConn(conn)
+	if err := m.handshake(ringConn, 0); err != nil {
+		log.Println("ERR: Handshake from", conn.RemoteAddr(), err)
+		conn.Close()
+		return err
+	}
+	if n := m.currentRing().Node(ringConn.PeerNodeID); n != nil {
+		if !addressMatchesRemote(n.Addresses[m.AddressIdx], conn.RemoteAddr()) {
+			log.Println("ERR: Peer", ringConn.PeerNodeID, "connected from", conn.RemoteAddr(), "but ring says it lives at", n.Addresses[m.AddressIdx])
 			conn.Close()
-			return errors.New("Didn't consume whole message")
+			return fmt.Errorf("peer %d address mismatch", ringConn.PeerNodeID)
 		}
 	}
+	// Register in the pool under the remote address so an idle accepted
+	// connection is reaped like any other, and so Close (e.g. from the
+	// reaper, or when the peer hangs up) removes this entry instead of
+	// leaking it forever.
+	m.pool.put(conn.RemoteAddr().String(), ringConn)
+	ringConn.startMux()
+	err := m.demux(ringConn, m.handleStream)
+	log.Println("Closing connection:", err)
+	ringConn.Close()
+	return err
+}
+
+// handleStream reads a single reassembled message (msgType, msgLength,
+// content) from a stream's reassembled reader and dispatches it to the
+// registered MsgUnmarshaller, or to an internalMsgHandler if msgType is one
+// of the ring package's own control message types (see peer_exchange.go).
+// One stream carries exactly one message, so unlike the old connection-wide
+// read loop this doesn't loop - demux spawns a new handleStream per
+// incoming stream ID. msize is the msize negotiated for this connection's
+// handshake; a header claiming a longer body is rejected before it reaches
+// a handler, since handlers routinely do make([]byte, length) and a peer is
+// otherwise free to claim an arbitrary length and force an unbounded
+// allocation.
+func (m *TCPMsgRing) handleStream(streamID uint32, peerNodeID uint64, msize uint64, r io.Reader) {
+	// r is the read side of demux's per-stream pipe; demux blocks on its
+	// write side until we read every byte it sends for this stream, no
+	// matter how we exit below. Without this drain, an unknown msgType, a
+	// DecodeHeader error, a handler error, or a short read would leave
+	// unread bytes in the pipe and wedge demux's single reader goroutine -
+	// and with it every other stream on the connection - forever.
+	defer io.Copy(io.Discard, r)
+	msgType, length, err := m.Codec.DecodeHeader(r)
+	if err != nil {
+		log.Println("ERR: Reading msg header on stream", streamID, "-", err)
+		return
+	}
+	if length > msize {
+		log.Println("ERR: Message length", length, "on stream", streamID, "exceeds negotiated msize", msize, "- rejecting")
+		return
+	}
+	var consumed uint64
+	if internal, ok := m.internalHandlers[msgType]; ok {
+		consumed, err = internal(peerNodeID, r, length)
+	} else if handle, ok := m.msgHandlers[msgType]; ok {
+		consumed, err = handle(r, length)
+	} else {
+		log.Println("ERR: Unknown message type", msgType, "on stream", streamID)
+		return
+	}
+	if err != nil {
+		log.Println("ERR: Error handling message on stream", streamID, "-", err)
+		return
+	}
+	if consumed != length {
+		log.Println("ERR: Didn't consume whole message on stream", streamID, "-", length, consumed)
+	}
 }
 
 func (m *TCPMsgRing) Listen(addr string) error {
@@ -201,4 +432,4 @@ func (m *TCPMsgRing) Listen(addr string) error {
 		}
 		go m.handle(conn)
 	}
-}
\ No newline at end of file
+}